@@ -0,0 +1,81 @@
+package servicediscovery
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheStats reports cumulative activity across the SRV and target caches.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// ttlCache is a TTL-expiring, thread-safe cache keyed by name. Entries are
+// invalidated lazily on get; RefreshInterval-driven background refresh
+// (see consulServiceDiscovery.refreshAll) is what keeps hot entries from
+// ever expiring in practice.
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]ttlEntry
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type ttlEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: make(map[string]ttlEntry)}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		c.misses++
+		c.evictions++
+		return nil, false
+	}
+
+	c.hits++
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = ttlEntry{value: value, expiresAt: time.Now().Add(ttl)}
+}
+
+// keys returns a snapshot of the cache's current keys, for the background
+// refresher to walk.
+func (c *ttlCache) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (c *ttlCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
@@ -0,0 +1,55 @@
+package servicediscovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheGetSetRoundTrip(t *testing.T) {
+	c := newTTLCache()
+
+	if _, ok := c.get("missing"); ok {
+		t.Fatalf("expected miss on empty cache")
+	}
+
+	c.set("key", "value", time.Minute)
+	got, ok := c.get("key")
+	if !ok || got != "value" {
+		t.Fatalf("expected to get back the cached value, got %v, %v", got, ok)
+	}
+
+	stats := c.stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %+v", stats)
+	}
+}
+
+func TestTTLCacheExpiresEntries(t *testing.T) {
+	c := newTTLCache()
+	c.set("key", "value", time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := c.get("key"); ok {
+		t.Fatalf("expected expired entry to be evicted on get")
+	}
+
+	stats := c.stats()
+	if stats.Evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %+v", stats)
+	}
+	if _, stillThere := c.entries["key"]; stillThere {
+		t.Fatalf("expected expired entry to be removed from the map")
+	}
+}
+
+func TestTTLCacheKeysSnapshot(t *testing.T) {
+	c := newTTLCache()
+	c.set("a", 1, time.Minute)
+	c.set("b", 2, time.Minute)
+
+	keys := c.keys()
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", keys)
+	}
+}
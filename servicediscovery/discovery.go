@@ -3,49 +3,148 @@ package servicediscovery
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/miekg/dns"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ServiceDiscovery resolves Consul service names to live instances over DNS.
+type ServiceDiscovery interface {
+	DiscoverService(serviceName string) (ip string, port string, err error)
+	DiscoverAllServiceInstances(serviceName string) ([]ServiceInstance, error)
+	DiscoverServiceWeighted(serviceName string) (ip string, port string, err error)
+	CacheStats() CacheStats
+	Close() error
+}
+
+// AddressFamilyPreference controls which address family resolveTarget
+// prefers when a target has both A and AAAA records.
+type AddressFamilyPreference int
+
+const (
+	// AnyAddressFamily prefers IPv4 but falls back to IPv6, matching the
+	// historical (IPv4-only) behavior when no AAAA record exists.
+	AnyAddressFamily AddressFamilyPreference = iota
+	IPv4Only
+	IPv6Only
+	PreferIPv6
+)
+
+// defaultTTL is how long a cache entry is kept when a resolver can't report
+// a TTL of its own (e.g. it had zero answers). It is not a minimum: a lower
+// TTL reported by the resolver is used as is.
+const defaultTTL = 30 * time.Second
+
+// defaultMaxConcurrentResolutions bounds how many target A/AAAA lookups
+// DiscoverAllServiceInstances runs at once for a single SRV response.
+const defaultMaxConcurrentResolutions = 8
+
+// Option configures a consulServiceDiscovery at construction time.
+type Option func(*consulServiceDiscovery)
+
+// WithAddressFamily sets the address family preference used to pick an IP
+// when a target resolves to both A and AAAA records.
+func WithAddressFamily(pref AddressFamilyPreference) Option {
+	return func(s *consulServiceDiscovery) {
+		s.addressFamily = pref
+	}
+}
+
+// WithRefreshInterval starts a background goroutine that re-resolves every
+// cached SRV and target name every interval, so hot entries are refreshed
+// before they expire instead of paying for resolution on the caller's
+// path. A zero interval (the default) disables background refresh;
+// entries are then resolved lazily on expiry.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(s *consulServiceDiscovery) {
+		s.refreshInterval = interval
+	}
+}
+
+// WithSelectionStrategy sets how DiscoverService picks a single instance out
+// of the RFC 2782-ordered list returned by DiscoverAllServiceInstances. It
+// defaults to RFC2782. DiscoverServiceWeighted always uses RFC2782
+// selection regardless of this setting.
+func WithSelectionStrategy(strategy SelectionStrategy) Option {
+	return func(s *consulServiceDiscovery) {
+		s.selectionStrategy = strategy
+	}
+}
+
+// WithMaxConcurrentResolutions bounds how many target A/AAAA lookups
+// DiscoverAllServiceInstances runs at once when resolving the targets of a
+// single SRV response. It defaults to 8.
+func WithMaxConcurrentResolutions(n int) Option {
+	return func(s *consulServiceDiscovery) {
+		s.maxConcurrentResolutions = n
+	}
+}
+
 type consulServiceDiscovery struct {
-	dnsServer   string
-	dnsSearch   string
-	client      DnsClient
-	targetCache map[string]net.IP
+	dnsSearch                string
+	resolver                 Resolver
+	addressFamily            AddressFamilyPreference
+	selectionStrategy        SelectionStrategy
+	roundRobinCounter        uint64
+	maxConcurrentResolutions int
+
+	srvCache    *ttlCache
+	targetCache *ttlCache
+
+	refreshInterval time.Duration
+	stopOnce        sync.Once
+	stopCh          chan struct{}
+	refreshWg       sync.WaitGroup
 }
 
 type ServiceInstance struct {
-	Ip   string
-	Port string
+	Ip       string
+	Port     string
+	Family   string
+	Priority uint16
+	Weight   uint16
 }
 
-func NewConsulServiceDiscovery(dnsServer string) (ServiceDiscovery, error) {
+// srvCacheEntry is the cached result of an SRV lookup, including any glue
+// records returned alongside it.
+type srvCacheEntry struct {
+	srvs []SRV
+	glue map[string][]net.IP
+}
 
-	host, port, err := net.SplitHostPort(dnsServer)
+// NewConsulServiceDiscovery resolves Consul SRV records by querying
+// dnsServer directly via miekg/dns. Use NewConsulServiceDiscoveryWithResolver
+// to pick a different backend, e.g. NewGoDNSResolver() to defer to the
+// system's DNS configuration instead of an explicit DNS server.
+func NewConsulServiceDiscovery(dnsServer string, opts ...Option) (ServiceDiscovery, error) {
+	resolver, err := NewMiekgResolver(dnsServer)
 	if err != nil {
 		return nil, err
 	}
+	return NewConsulServiceDiscoveryWithResolver(resolver, opts...)
+}
 
-	// If it is not an IP address try to resolve the DNS name.
-	// This is used for local development.
-	if net.ParseIP(host) == nil {
-		addrs, err := net.LookupHost(host)
-		if err != nil {
-			return nil, err
-		}
-		if len(addrs) == 0 {
-			log.WithField("host", host).Error("No service discovery host could be resolved")
-			return nil, fmt.Errorf("No service discovery host could be resolved")
-		}
-		dnsServer = net.JoinHostPort(addrs[0], port)
+// NewConsulServiceDiscoveryWithResolver builds a ServiceDiscovery on top of
+// an arbitrary Resolver backend.
+func NewConsulServiceDiscoveryWithResolver(resolver Resolver, opts ...Option) (ServiceDiscovery, error) {
+	ret := &consulServiceDiscovery{
+		dnsSearch:                ".service.consul",
+		resolver:                 resolver,
+		srvCache:                 newTTLCache(),
+		targetCache:              newTTLCache(),
+		stopCh:                   make(chan struct{}),
+		maxConcurrentResolutions: defaultMaxConcurrentResolutions,
 	}
 
-	ret := consulServiceDiscovery{
-		dnsServer:   dnsServer,
-		dnsSearch:   ".service.consul",
-		client:      &dns.Client{},
-		targetCache: make(map[string]net.IP)}
-	return &ret, nil
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	ret.startRefresher()
+
+	return ret, nil
 }
 
 func (s *consulServiceDiscovery) DiscoverService(serviceName string) (ip string, port string, err error) {
@@ -59,81 +158,314 @@ func (s *consulServiceDiscovery) DiscoverService(serviceName string) (ip string,
 		return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
 	}
 
+	instance := s.selectInstance(instances)
+	return instance.Ip, instance.Port, nil
+}
+
+// DiscoverServiceWeighted returns a single instance chosen by the RFC 2782
+// weighted random selection, regardless of the configured SelectionStrategy.
+func (s *consulServiceDiscovery) DiscoverServiceWeighted(serviceName string) (ip string, port string, err error) {
+	instances, err := s.DiscoverAllServiceInstances(serviceName)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(instances) == 0 {
+		log.WithField("serviceName", serviceName).Error("Service lookup: No SRV entry in DNS response")
+		return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	}
+
 	return instances[0].Ip, instances[0].Port, nil
 }
 
+// selectInstance picks one of instances, which is always ordered by
+// DiscoverAllServiceInstances per RFC 2782 (ascending priority, weighted
+// random within each priority group), according to s.selectionStrategy.
+func (s *consulServiceDiscovery) selectInstance(instances []ServiceInstance) ServiceInstance {
+	switch s.selectionStrategy {
+	case RoundRobin:
+		// Cycle over a stable ordering rather than the RFC 2782 ordering in
+		// instances, which is re-shuffled by a fresh weighted random draw on
+		// every call and would make RoundRobin indistinguishable from
+		// Random.
+		ordered := stableOrder(instances)
+		idx := int(atomic.AddUint64(&s.roundRobinCounter, 1)-1) % len(ordered)
+		return ordered[idx]
+	case Random:
+		return instances[rand.Intn(len(instances))]
+	case FirstHealthy:
+		return instances[0]
+	default: // RFC2782
+		return instances[0]
+	}
+}
+
 func (s *consulServiceDiscovery) DiscoverAllServiceInstances(serviceName string) (instances []ServiceInstance, err error) {
 
-	instances = make([]ServiceInstance, 0)
+	fqdn := serviceName + s.dnsSearch
+
+	entry, ok := s.srvCache.get(fqdn)
+	var srvEntry srvCacheEntry
+	if ok {
+		srvEntry = entry.(srvCacheEntry)
+	} else {
+		srvEntry, err = s.lookupSRVFresh(fqdn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve each SRV target's A/AAAA records across a bounded worker
+	// pool instead of serially. Each goroutine only ever writes its own
+	// index of resolved, so no lock is needed to keep the SRV ordering.
+	resolved := make([]*ServiceInstance, len(srvEntry.srvs))
+	sem := make(chan struct{}, s.maxConcurrentResolutions)
+	var wg sync.WaitGroup
+
+	for i, srv := range srvEntry.srvs {
+		i, srv := i, srv
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			target := srv.Target[:len(srv.Target)-1]
+
+			var ip net.IP
+			if targetIps, haveGlue := srvEntry.glue[srv.Target]; haveGlue {
+				ip = selectByFamily(targetIps, s.addressFamily)
+			}
+
+			// No glue, or the glue didn't cover the address family we need
+			// (e.g. Consul only returned an A record but we want IPv6): fall
+			// back to resolving the target ourselves instead of dropping the
+			// instance.
+			if ip == nil {
+				sem <- struct{}{}
+				targetIps, resolveErr := s.resolveTargetAddrs(target)
+				<-sem
+				if resolveErr != nil {
+					return
+				}
+				ip = selectByFamily(targetIps, s.addressFamily)
+			}
+
+			if ip == nil {
+				return
+			}
+
+			resolved[i] = &ServiceInstance{
+				Ip:       ip.String(),
+				Family:   familyOf(ip),
+				Port:     fmt.Sprintf("%d", srv.Port),
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	instances = make([]ServiceInstance, 0, len(resolved))
+	for _, inst := range resolved {
+		if inst != nil {
+			instances = append(instances, *inst)
+		}
+	}
+
+	return orderByPriorityAndWeight(instances), nil
+}
 
-	m := new(dns.Msg)
-	fqdn := dns.Fqdn(serviceName + s.dnsSearch)
-	m.SetQuestion(fqdn, dns.TypeSRV)
+// lookupSRVFresh resolves fqdn's SRV records (and glue, if the backend
+// supports it) and caches the result for the lowest TTL among the answers.
+func (s *consulServiceDiscovery) lookupSRVFresh(fqdn string) (srvCacheEntry, error) {
+	var srvs []SRV
+	var glue map[string][]net.IP
+	var err error
 
-	r, _, err := s.client.Exchange(m, s.dnsServer)
+	if glueResolver, ok := s.resolver.(GlueResolver); ok {
+		srvs, glue, err = glueResolver.LookupSRVWithGlue(fqdn)
+	} else {
+		srvs, err = s.resolver.LookupSRV(fqdn)
+	}
 	if err != nil {
-		log.WithField("serviceName", fqdn).
-			WithField("dnsServer", s.dnsServer).
-			WithField("error", err).
-			Error("Error during connection to DNS server")
-		return nil, err
+		return srvCacheEntry{}, err
 	}
 
-	if r.Rcode != dns.RcodeSuccess {
-		log.WithField("serviceName", fqdn).Error("Service lookup: DNS query did not succeed")
-		return nil, fmt.Errorf("Service lookup: DNS query did not succeed")
+	entry := srvCacheEntry{srvs: srvs, glue: glue}
+	s.srvCache.set(fqdn, entry, minTTL(srvs))
+	return entry, nil
+}
+
+func minTTL(srvs []SRV) time.Duration {
+	if len(srvs) == 0 {
+		return defaultTTL
 	}
 
-	for _, a := range r.Answer {
-		if srv, ok := a.(*dns.SRV); ok {
-			target := srv.Target[:len(srv.Target)-1]
-			targetIp, err := s.resolveTarget(target)
-			if err == nil {
-				instances = append(instances, ServiceInstance{
-					Ip:   targetIp.String(),
-					Port: fmt.Sprintf("%d", srv.Port),
-				})
-			}
+	ttl := srvs[0].TTL
+	for _, srv := range srvs[1:] {
+		if srv.TTL < ttl {
+			ttl = srv.TTL
 		}
 	}
+	return ttl
+}
 
-	return instances, nil
+// resolveTargetAddrs returns target's cached A/AAAA addresses, resolving
+// and caching them on a miss.
+func (s *consulServiceDiscovery) resolveTargetAddrs(target string) ([]net.IP, error) {
+	if cached, ok := s.targetCache.get(target); ok {
+		return cached.([]net.IP), nil
+	}
+	return s.resolveTargetAddrsFresh(target)
 }
 
-func (s *consulServiceDiscovery) resolveTarget(target string) (ip net.IP, err error) {
+// resolveTargetAddrsFresh resolves target's A and AAAA records in parallel
+// and caches the combined result for the lower of the two TTLs.
+func (s *consulServiceDiscovery) resolveTargetAddrsFresh(target string) ([]net.IP, error) {
+	type lookupResult struct {
+		ip  net.IP
+		ttl time.Duration
+		err error
+	}
+
+	aCh := make(chan lookupResult, 1)
+	aaaaCh := make(chan lookupResult, 1)
+
+	go func() {
+		ip, ttl, err := s.resolver.LookupA(target)
+		aCh <- lookupResult{ip, ttl, err}
+	}()
+	go func() {
+		ip, ttl, err := s.resolver.LookupAAAA(target)
+		aaaaCh <- lookupResult{ip, ttl, err}
+	}()
+
+	aRes, aaaaRes := <-aCh, <-aaaaCh
+
+	var ips []net.IP
+	ttl := defaultTTL
+	haveTTL := false
+	if aRes.err == nil && aRes.ip != nil {
+		ips = append(ips, aRes.ip)
+		ttl, haveTTL = aRes.ttl, true
+	}
+	if aaaaRes.err == nil && aaaaRes.ip != nil {
+		ips = append(ips, aaaaRes.ip)
+		if !haveTTL || aaaaRes.ttl < ttl {
+			ttl = aaaaRes.ttl
+		}
+	}
 
-	if val, ok := s.targetCache[target]; ok {
-		return val, nil
+	if len(ips) == 0 {
+		if aRes.err != nil {
+			return nil, aRes.err
+		}
+		return nil, aaaaRes.err
 	}
 
-	fqdn := dns.Fqdn(target)
+	s.targetCache.set(target, ips, ttl)
+	return ips, nil
+}
 
-	m := new(dns.Msg)
-	m.SetQuestion(fqdn, dns.TypeA)
+// selectByFamily picks an IP from ips according to pref, preferring IPv4
+// when pref doesn't force a specific family and both are available.
+func selectByFamily(ips []net.IP, pref AddressFamilyPreference) net.IP {
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
 
-	r, _, err := s.client.Exchange(m, s.dnsServer)
-	if err != nil {
-		log.WithField("fqdn", fqdn).
-			WithField("target", target).
-			WithField("dnsServer", s.dnsServer).
-			WithField("error", err).
-			Error("Error during connection to DNS server")
-		return nil, err
+	switch pref {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv6:
+		if v6 != nil {
+			return v6
+		}
+		return v4
+	default:
+		if v4 != nil {
+			return v4
+		}
+		return v6
+	}
+}
+
+func familyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
 	}
+	return "ipv6"
+}
 
-	if r.Rcode != dns.RcodeSuccess {
-		log.WithField("fqdn", fqdn).WithField("target", target).Error("Service lookup: Target DNS query did not succeed")
-		return nil, fmt.Errorf("Service lookup: Target DNS query did not succeed")
+// CacheStats returns combined hit/miss/eviction counters across the SRV
+// and target caches.
+func (s *consulServiceDiscovery) CacheStats() CacheStats {
+	srvStats := s.srvCache.stats()
+	targetStats := s.targetCache.stats()
+	return CacheStats{
+		Hits:      srvStats.Hits + targetStats.Hits,
+		Misses:    srvStats.Misses + targetStats.Misses,
+		Evictions: srvStats.Evictions + targetStats.Evictions,
 	}
+}
+
+// startRefresher launches the background refresh loop when a non-zero
+// RefreshInterval was configured.
+func (s *consulServiceDiscovery) startRefresher() {
+	if s.refreshInterval <= 0 {
+		return
+	}
+
+	s.refreshWg.Add(1)
+	go func() {
+		defer s.refreshWg.Done()
+
+		ticker := time.NewTicker(s.refreshInterval)
+		defer ticker.Stop()
 
-	for _, a := range r.Answer {
-		if srv, ok := a.(*dns.A); ok {
-			s.targetCache[target] = srv.A
-			return srv.A, nil
+		for {
+			select {
+			case <-ticker.C:
+				s.refreshAll()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// refreshAll re-resolves every name currently in the SRV and target caches,
+// keeping them from expiring under steady request load.
+func (s *consulServiceDiscovery) refreshAll() {
+	for _, name := range s.srvCache.keys() {
+		if _, err := s.lookupSRVFresh(name); err != nil {
+			log.WithField("name", name).WithField("error", err).Warn("Background refresh of SRV cache entry failed")
 		}
 	}
 
-	log.WithField("fqdn", fqdn).WithField("target", target).Error("Service lookup: No A entry in DNS response")
-	return nil, fmt.Errorf("Service lookup: No A entry in DNS response")
+	for _, target := range s.targetCache.keys() {
+		if _, err := s.resolveTargetAddrsFresh(target); err != nil {
+			log.WithField("target", target).WithField("error", err).Warn("Background refresh of target cache entry failed")
+		}
+	}
+}
 
+// Close stops the background refresher, if one was started. It is safe to
+// call multiple times.
+func (s *consulServiceDiscovery) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.refreshWg.Wait()
+	return nil
 }
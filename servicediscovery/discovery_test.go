@@ -0,0 +1,177 @@
+package servicediscovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResolver is a minimal Resolver (and GlueResolver) backend for testing
+// consulServiceDiscovery without touching real DNS.
+type fakeResolver struct {
+	srvs []SRV
+	glue map[string][]net.IP
+
+	aRecords    map[string]net.IP
+	aaaaRecords map[string]net.IP
+}
+
+func (f *fakeResolver) LookupSRV(name string) ([]SRV, error) {
+	return f.srvs, nil
+}
+
+func (f *fakeResolver) LookupSRVWithGlue(name string) ([]SRV, map[string][]net.IP, error) {
+	return f.srvs, f.glue, nil
+}
+
+func (f *fakeResolver) LookupA(target string) (net.IP, time.Duration, error) {
+	if ip, ok := f.aRecords[target]; ok {
+		return ip, time.Minute, nil
+	}
+	return nil, 0, ErrNotFound
+}
+
+func (f *fakeResolver) LookupAAAA(target string) (net.IP, time.Duration, error) {
+	if ip, ok := f.aaaaRecords[target]; ok {
+		return ip, time.Minute, nil
+	}
+	return nil, 0, ErrNotFound
+}
+
+func (f *fakeResolver) IsNotFound(err error) bool {
+	return IsNotFound(err)
+}
+
+func TestDiscoverAllServiceInstancesFallsBackWhenGlueMissesFamily(t *testing.T) {
+	resolver := &fakeResolver{
+		srvs: []SRV{
+			{Target: "web1.service.consul.", Port: 8080, Priority: 1, Weight: 1, TTL: time.Minute},
+		},
+		// Consul only returned an A glue record for this target...
+		glue: map[string][]net.IP{
+			"web1.service.consul.": {net.ParseIP("10.0.0.1")},
+		},
+		// ...but a AAAA record exists if we go look for it ourselves.
+		aaaaRecords: map[string]net.IP{
+			"web1.service.consul": net.ParseIP("2001:db8::1"),
+		},
+	}
+
+	sd, err := NewConsulServiceDiscoveryWithResolver(resolver, WithAddressFamily(IPv6Only))
+	if err != nil {
+		t.Fatalf("NewConsulServiceDiscoveryWithResolver: %v", err)
+	}
+	defer sd.Close()
+
+	instances, err := sd.DiscoverAllServiceInstances("web")
+	if err != nil {
+		t.Fatalf("DiscoverAllServiceInstances: %v", err)
+	}
+
+	if len(instances) != 1 {
+		t.Fatalf("expected the instance to be resolved via fallback instead of dropped, got %v", instances)
+	}
+	if instances[0].Ip != "2001:db8::1" || instances[0].Family != "ipv6" {
+		t.Fatalf("expected the fallback-resolved AAAA address, got %+v", instances[0])
+	}
+}
+
+func TestDiscoverAllServiceInstancesUsesGlueWhenFamilyMatches(t *testing.T) {
+	resolver := &fakeResolver{
+		srvs: []SRV{
+			{Target: "web1.service.consul.", Port: 8080, Priority: 1, Weight: 1, TTL: time.Minute},
+		},
+		glue: map[string][]net.IP{
+			"web1.service.consul.": {net.ParseIP("10.0.0.1")},
+		},
+		// If glue is used, this record should never be consulted.
+		aRecords: map[string]net.IP{
+			"web1.service.consul": net.ParseIP("10.0.0.99"),
+		},
+	}
+
+	sd, err := NewConsulServiceDiscoveryWithResolver(resolver, WithAddressFamily(IPv4Only))
+	if err != nil {
+		t.Fatalf("NewConsulServiceDiscoveryWithResolver: %v", err)
+	}
+	defer sd.Close()
+
+	instances, err := sd.DiscoverAllServiceInstances("web")
+	if err != nil {
+		t.Fatalf("DiscoverAllServiceInstances: %v", err)
+	}
+
+	if len(instances) != 1 || instances[0].Ip != "10.0.0.1" {
+		t.Fatalf("expected the glue-provided address, got %v", instances)
+	}
+}
+
+func TestDiscoverAllServiceInstancesResolvesAllTargetsConcurrently(t *testing.T) {
+	const numTargets = 20
+
+	resolver := &fakeResolver{
+		aRecords: make(map[string]net.IP, numTargets),
+	}
+	for i := 0; i < numTargets; i++ {
+		target := targetName(i)
+		resolver.srvs = append(resolver.srvs, SRV{
+			Target:   target + ".",
+			Port:     8080,
+			Priority: 1,
+			Weight:   1,
+			TTL:      time.Minute,
+		})
+		resolver.aRecords[target] = net.ParseIP(targetIP(i))
+	}
+
+	sd, err := NewConsulServiceDiscoveryWithResolver(resolver, WithMaxConcurrentResolutions(3))
+	if err != nil {
+		t.Fatalf("NewConsulServiceDiscoveryWithResolver: %v", err)
+	}
+	defer sd.Close()
+
+	instances, err := sd.DiscoverAllServiceInstances("web")
+	if err != nil {
+		t.Fatalf("DiscoverAllServiceInstances: %v", err)
+	}
+
+	if len(instances) != numTargets {
+		t.Fatalf("expected all %d targets to resolve, got %d: %v", numTargets, len(instances), instances)
+	}
+
+	seen := make(map[string]bool, numTargets)
+	for _, inst := range instances {
+		seen[inst.Ip] = true
+	}
+	for i := 0; i < numTargets; i++ {
+		if !seen[targetIP(i)] {
+			t.Fatalf("missing resolved address %s in %v", targetIP(i), instances)
+		}
+	}
+}
+
+func targetName(i int) string {
+	return "web" + string(rune('a'+i)) + ".service.consul"
+}
+
+func targetIP(i int) string {
+	return net.IPv4(10, 0, byte(i/256), byte(i%256)).String()
+}
+
+func TestMinTTLEmptyReturnsDefault(t *testing.T) {
+	if got := minTTL(nil); got != defaultTTL {
+		t.Fatalf("minTTL(nil) = %v, want %v", got, defaultTTL)
+	}
+}
+
+func TestMinTTLReturnsLowest(t *testing.T) {
+	srvs := []SRV{
+		{TTL: 60 * time.Second},
+		{TTL: 10 * time.Second},
+		{TTL: 30 * time.Second},
+	}
+
+	if got, want := minTTL(srvs), 10*time.Second; got != want {
+		t.Fatalf("minTTL() = %v, want %v", got, want)
+	}
+}
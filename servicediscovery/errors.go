@@ -0,0 +1,51 @@
+package servicediscovery
+
+import "errors"
+
+// Sentinel errors returned (wrapped, via %w) by Resolver implementations so
+// callers can distinguish why a lookup failed instead of pattern-matching
+// on error strings.
+var (
+	// ErrNotFound indicates the requested service or target simply has no
+	// matching DNS record (NXDOMAIN, or a NOERROR response with an empty
+	// answer section), as opposed to a DNS infrastructure problem.
+	ErrNotFound = errors.New("servicediscovery: no such service")
+
+	// ErrNoSuchHost indicates the configured DNS server's own hostname
+	// could not be resolved.
+	ErrNoSuchHost = errors.New("servicediscovery: no such host")
+
+	// ErrTruncated indicates the DNS server's response was still truncated
+	// after retrying the query over TCP.
+	ErrTruncated = errors.New("servicediscovery: DNS response truncated")
+
+	// ErrServerFailure indicates the DNS server returned an error rcode
+	// other than NXDOMAIN (e.g. SERVFAIL). Errors reaching the server are
+	// returned as they are, without a sentinel.
+	ErrServerFailure = errors.New("servicediscovery: DNS server failure")
+)
+
+// IsNotFound reports whether err means the requested service simply doesn't
+// exist in DNS, as opposed to a DNS infrastructure problem. It deliberately
+// excludes ErrNoSuchHost: that means the configured DNS server itself
+// couldn't be resolved, not that the service is missing, and callers
+// shouldn't treat a dead DNS server as an ordinary not-found result.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// dnsError pairs a sentinel error with the failure reason used to label
+// the servicediscovery_dns_lookup_failures_total metric, without forcing
+// every caller to re-derive the reason from the error string.
+type dnsError struct {
+	err    error
+	reason failureReason
+}
+
+func (e *dnsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dnsError) Unwrap() error {
+	return e.err
+}
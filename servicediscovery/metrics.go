@@ -0,0 +1,97 @@
+package servicediscovery
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"time"
+)
+
+// failureReason labels the servicediscovery_dns_lookup_failures_total
+// metric, distinguishing classes of DNS failure that callers otherwise
+// have to guess at from an error string.
+type failureReason string
+
+const (
+	reasonNetwork   failureReason = "network_error"
+	reasonNXDomain  failureReason = "nxdomain"
+	reasonServFail  failureReason = "servfail"
+	reasonTruncated failureReason = "truncation"
+	reasonEmpty     failureReason = "empty_answer"
+)
+
+var (
+	dnsLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "servicediscovery_dns_lookups_total",
+			Help: "Total number of DNS lookups performed, by record type and result.",
+		},
+		[]string{"type", "result"},
+	)
+
+	dnsLookupDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "servicediscovery_dns_lookup_duration_seconds",
+			Help:    "Duration of DNS lookups in seconds, by record type.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"type"},
+	)
+
+	dnsLookupFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "servicediscovery_dns_lookup_failures_total",
+			Help: "Total number of failed DNS lookups, by record type and failure reason.",
+		},
+		[]string{"type", "reason"},
+	)
+)
+
+// Register registers the package's DNS lookup metrics with reg. It is an
+// error to call it twice with the same registry.
+func Register(reg *prometheus.Registry) error {
+	for _, c := range collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustRegister is like Register but panics on error, mirroring
+// prometheus.Registry.MustRegister.
+func MustRegister(reg *prometheus.Registry) {
+	reg.MustRegister(collectors()...)
+}
+
+func collectors() []prometheus.Collector {
+	return []prometheus.Collector{dnsLookupsTotal, dnsLookupDurationSeconds, dnsLookupFailuresTotal}
+}
+
+// observeLookup records the outcome of a single DNS lookup of lookupType
+// ("SRV", "A" or "AAAA") for the exported metrics.
+func observeLookup(lookupType string, start time.Time, err error) {
+	dnsLookupDurationSeconds.WithLabelValues(lookupType).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		dnsLookupsTotal.WithLabelValues(lookupType, "success").Inc()
+		return
+	}
+
+	dnsLookupsTotal.WithLabelValues(lookupType, "failure").Inc()
+	dnsLookupFailuresTotal.WithLabelValues(lookupType, string(classifyFailure(err))).Inc()
+}
+
+func classifyFailure(err error) failureReason {
+	var dnsErr *dnsError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.reason
+	}
+
+	var netErr *net.DNSError
+	if errors.As(err, &netErr) && netErr.IsNotFound {
+		return reasonNXDomain
+	}
+
+	return reasonNetwork
+}
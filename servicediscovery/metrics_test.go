@@ -0,0 +1,50 @@
+package servicediscovery
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want failureReason
+	}{
+		{"rcode NXDOMAIN", rcodeError("web.service.consul.", dns.RcodeNameError), reasonNXDomain},
+		{"rcode SERVFAIL", rcodeError("web.service.consul.", dns.RcodeServerFailure), reasonServFail},
+		{"rcode other non-success", rcodeError("web.service.consul.", dns.RcodeRefused), reasonServFail},
+		{"empty answer", emptyAnswerError("web.service.consul.", "SRV"), reasonEmpty},
+		{"truncated", truncatedError("web.service.consul."), reasonTruncated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.err); got != tt.want {
+				t.Fatalf("classifyFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRcodeErrorIsNotFoundOnlyForNameError(t *testing.T) {
+	if !IsNotFound(rcodeError("web.service.consul.", dns.RcodeNameError)) {
+		t.Fatalf("expected NXDOMAIN rcode to round-trip through IsNotFound")
+	}
+	if IsNotFound(rcodeError("web.service.consul.", dns.RcodeServerFailure)) {
+		t.Fatalf("SERVFAIL should not be reported as IsNotFound")
+	}
+}
+
+func TestEmptyAnswerErrorIsNotFound(t *testing.T) {
+	if !IsNotFound(emptyAnswerError("web.service.consul.", "SRV")) {
+		t.Fatalf("expected an empty-answer error to round-trip through IsNotFound")
+	}
+}
+
+func TestTruncatedErrorIsNotIsNotFound(t *testing.T) {
+	if IsNotFound(truncatedError("web.service.consul.")) {
+		t.Fatalf("a truncated response is a transport problem, not IsNotFound")
+	}
+}
@@ -0,0 +1,471 @@
+package servicediscovery
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// godnsDefaultTTL is used as the TTL for records returned by godnsResolver,
+// since net.Resolver does not expose the TTL of the records it resolved.
+const godnsDefaultTTL = 30 * time.Second
+
+// SRV is a resolver-agnostic view of a DNS SRV record, carrying only the
+// fields callers need regardless of whether the answer came from
+// miekg/dns or the Go standard library resolver.
+type SRV struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	TTL      time.Duration
+}
+
+// Resolver is the DNS backend used by consulServiceDiscovery to resolve SRV
+// records and the A/AAAA records of their targets. Swapping the
+// implementation lets callers choose between talking to a DNS server
+// directly (miekg/dns) or deferring to the operating system's resolver
+// (net.Resolver), e.g. to honor /etc/resolv.conf, search domains or
+// /etc/hosts.
+type Resolver interface {
+	LookupSRV(name string) ([]SRV, error)
+	LookupA(target string) (ip net.IP, ttl time.Duration, err error)
+	LookupAAAA(target string) (ip net.IP, ttl time.Duration, err error)
+	IsNotFound(err error) bool
+}
+
+// GlueResolver is implemented by Resolver backends that can return the
+// A/AAAA glue records Consul includes in the Additional section of an SRV
+// response, letting callers skip a separate round trip per target.
+type GlueResolver interface {
+	LookupSRVWithGlue(name string) (srvs []SRV, glue map[string][]net.IP, err error)
+}
+
+// defaultUDPBufferSize is the EDNS0 buffer size advertised on outgoing UDP
+// queries, large enough that most Consul SRV answers (including their
+// Additional section glue) fit without needing the TCP fallback.
+const defaultUDPBufferSize = 4096
+
+// miekgResolver resolves records by exchanging DNS messages with an
+// explicitly configured DNS server using miekg/dns.
+type miekgResolver struct {
+	dnsServer     string
+	udpClient     *dns.Client
+	tcpClient     *dns.Client
+	udpBufferSize uint16
+}
+
+// MiekgResolverOption configures a miekgResolver at construction time.
+type MiekgResolverOption func(*miekgResolver)
+
+// WithUDPBufferSize sets the EDNS0 buffer size advertised on outgoing UDP
+// queries. Larger values reduce how often answers are truncated and need
+// to be retried over TCP.
+func WithUDPBufferSize(size uint16) MiekgResolverOption {
+	return func(r *miekgResolver) {
+		r.udpBufferSize = size
+	}
+}
+
+// NewMiekgResolver returns a Resolver that queries dnsServer directly using
+// miekg/dns. dnsServer must be host:port; host may be an IP address or a
+// hostname, in which case the hostname is resolved once up front (used for
+// local development).
+func NewMiekgResolver(dnsServer string, opts ...MiekgResolverOption) (Resolver, error) {
+	host, port, err := net.SplitHostPort(dnsServer)
+	if err != nil {
+		return nil, err
+	}
+
+	// If it is not an IP address try to resolve the DNS name.
+	// This is used for local development.
+	if net.ParseIP(host) == nil {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchHost, err)
+		}
+		if len(addrs) == 0 {
+			log.WithField("host", host).Error("No service discovery host could be resolved")
+			return nil, fmt.Errorf("%w: no address found for %s", ErrNoSuchHost, host)
+		}
+		dnsServer = net.JoinHostPort(addrs[0], port)
+	}
+
+	r := &miekgResolver{
+		dnsServer:     dnsServer,
+		udpClient:     &dns.Client{},
+		tcpClient:     &dns.Client{Net: "tcp"},
+		udpBufferSize: defaultUDPBufferSize,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// exchange sends m to the configured DNS server over UDP, enabling EDNS0 to
+// raise the UDP answer size limit, and transparently retries over TCP if
+// the UDP response still comes back truncated.
+func (r *miekgResolver) exchange(m *dns.Msg) (*dns.Msg, error) {
+	m.SetEdns0(r.udpBufferSize, false)
+
+	resp, _, err := r.udpClient.Exchange(m, r.dnsServer)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Truncated {
+		resp, _, err = r.tcpClient.Exchange(m, r.dnsServer)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Truncated {
+			return nil, truncatedError(m.Question[0].Name)
+		}
+	}
+
+	return resp, nil
+}
+
+func (r *miekgResolver) LookupSRV(name string) (srvs []SRV, err error) {
+	start := time.Now()
+	defer func() { observeLookup("SRV", start, err) }()
+
+	fqdn := dns.Fqdn(name)
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSRV)
+
+	resp, err := r.exchange(m)
+	if err != nil {
+		log.WithField("name", fqdn).
+			WithField("dnsServer", r.dnsServer).
+			WithField("error", err).
+			Error("Error during connection to DNS server")
+		return nil, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		err = rcodeError(fqdn, resp.Rcode)
+		log.WithField("name", fqdn).WithField("error", err).Error("Service lookup: DNS query did not succeed")
+		return nil, err
+	}
+
+	srvs = srvsFromAnswer(resp.Answer)
+	if len(srvs) == 0 {
+		err = emptyAnswerError(fqdn, "SRV")
+		return nil, err
+	}
+
+	return srvs, nil
+}
+
+func srvsFromAnswer(answer []dns.RR) []SRV {
+	srvs := make([]SRV, 0, len(answer))
+	for _, a := range answer {
+		if srv, ok := a.(*dns.SRV); ok {
+			srvs = append(srvs, SRV{
+				Target:   srv.Target,
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				TTL:      time.Duration(srv.Hdr.Ttl) * time.Second,
+			})
+		}
+	}
+	return srvs
+}
+
+func (r *miekgResolver) LookupA(target string) (ip net.IP, ttl time.Duration, err error) {
+	start := time.Now()
+	defer func() { observeLookup("A", start, err) }()
+
+	fqdn := dns.Fqdn(target)
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeA)
+
+	resp, err := r.exchange(m)
+	if err != nil {
+		log.WithField("fqdn", fqdn).
+			WithField("target", target).
+			WithField("dnsServer", r.dnsServer).
+			WithField("error", err).
+			Error("Error during connection to DNS server")
+		return nil, 0, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		err = rcodeError(fqdn, resp.Rcode)
+		log.WithField("fqdn", fqdn).WithField("target", target).WithField("error", err).Error("Service lookup: Target DNS query did not succeed")
+		return nil, 0, err
+	}
+
+	for _, a := range resp.Answer {
+		if arec, ok := a.(*dns.A); ok {
+			return arec.A, time.Duration(arec.Hdr.Ttl) * time.Second, nil
+		}
+	}
+
+	err = emptyAnswerError(fqdn, "A")
+	return nil, 0, err
+}
+
+func (r *miekgResolver) LookupAAAA(target string) (ip net.IP, ttl time.Duration, err error) {
+	start := time.Now()
+	defer func() { observeLookup("AAAA", start, err) }()
+
+	fqdn := dns.Fqdn(target)
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeAAAA)
+
+	resp, err := r.exchange(m)
+	if err != nil {
+		log.WithField("fqdn", fqdn).
+			WithField("target", target).
+			WithField("dnsServer", r.dnsServer).
+			WithField("error", err).
+			Error("Error during connection to DNS server")
+		return nil, 0, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		err = rcodeError(fqdn, resp.Rcode)
+		log.WithField("fqdn", fqdn).WithField("target", target).WithField("error", err).Error("Service lookup: Target DNS query did not succeed")
+		return nil, 0, err
+	}
+
+	for _, a := range resp.Answer {
+		if aaaa, ok := a.(*dns.AAAA); ok {
+			return aaaa.AAAA, time.Duration(aaaa.Hdr.Ttl) * time.Second, nil
+		}
+	}
+
+	err = emptyAnswerError(fqdn, "AAAA")
+	return nil, 0, err
+}
+
+// LookupSRVWithGlue behaves like LookupSRV but also returns the A/AAAA
+// records Consul attaches to the Additional section of the response, keyed
+// by the (dot-terminated) hostname they answer for.
+func (r *miekgResolver) LookupSRVWithGlue(name string) (srvs []SRV, glue map[string][]net.IP, err error) {
+	start := time.Now()
+	defer func() { observeLookup("SRV", start, err) }()
+
+	fqdn := dns.Fqdn(name)
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSRV)
+
+	resp, err := r.exchange(m)
+	if err != nil {
+		log.WithField("name", fqdn).
+			WithField("dnsServer", r.dnsServer).
+			WithField("error", err).
+			Error("Error during connection to DNS server")
+		return nil, nil, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		err = rcodeError(fqdn, resp.Rcode)
+		log.WithField("name", fqdn).WithField("error", err).Error("Service lookup: DNS query did not succeed")
+		return nil, nil, err
+	}
+
+	srvs = srvsFromAnswer(resp.Answer)
+	if len(srvs) == 0 {
+		err = emptyAnswerError(fqdn, "SRV")
+		return nil, nil, err
+	}
+
+	return srvs, glueFromExtra(resp.Extra), nil
+}
+
+// glueFromExtra builds a map of hostname -> IPs from the Additional section
+// of an SRV response, following any CNAME chains Consul emits when a
+// service is registered with a non-IP address.
+func glueFromExtra(extra []dns.RR) map[string][]net.IP {
+	cnames := make(map[string]string)
+	ips := make(map[string][]net.IP)
+
+	for _, rr := range extra {
+		switch rec := rr.(type) {
+		case *dns.A:
+			ips[rec.Hdr.Name] = append(ips[rec.Hdr.Name], rec.A)
+		case *dns.AAAA:
+			ips[rec.Hdr.Name] = append(ips[rec.Hdr.Name], rec.AAAA)
+		case *dns.CNAME:
+			cnames[rec.Hdr.Name] = rec.Target
+		}
+	}
+
+	glue := make(map[string][]net.IP, len(ips))
+	for name, addrs := range ips {
+		glue[name] = addrs
+	}
+
+	// Chase CNAME chains as far as the Extra section lets us; if the chain
+	// doesn't bottom out in an A/AAAA also present in Extra, the caller
+	// falls back to resolving the target the normal way.
+	const maxChainDepth = 5
+	for name, target := range cnames {
+		cur := target
+		for i := 0; i < maxChainDepth; i++ {
+			if addrs, ok := ips[cur]; ok {
+				glue[name] = addrs
+				break
+			}
+			next, ok := cnames[cur]
+			if !ok {
+				break
+			}
+			cur = next
+		}
+	}
+
+	return glue
+}
+
+// rcodeError classifies a non-success DNS rcode into a sentinel-wrapped,
+// metric-labeled error.
+func rcodeError(fqdn string, rcode int) error {
+	switch rcode {
+	case dns.RcodeNameError:
+		return &dnsError{
+			err:    fmt.Errorf("%w: %s", ErrNotFound, fqdn),
+			reason: reasonNXDomain,
+		}
+	case dns.RcodeServerFailure:
+		return &dnsError{
+			err:    fmt.Errorf("%w: %s", ErrServerFailure, fqdn),
+			reason: reasonServFail,
+		}
+	default:
+		return &dnsError{
+			err:    fmt.Errorf("%w: %s (rcode %d)", ErrServerFailure, fqdn, rcode),
+			reason: reasonServFail,
+		}
+	}
+}
+
+// emptyAnswerError classifies a NOERROR response with no matching record
+// of recordType as "not found", distinct from an NXDOMAIN rcode but
+// reported under the same sentinel since both mean the record isn't there.
+func emptyAnswerError(fqdn, recordType string) error {
+	return &dnsError{
+		err:    fmt.Errorf("%w: no %s entry for %s", ErrNotFound, recordType, fqdn),
+		reason: reasonEmpty,
+	}
+}
+
+// truncatedError classifies a response that was still truncated after the
+// TCP retry.
+func truncatedError(fqdn string) error {
+	return &dnsError{
+		err:    fmt.Errorf("%w: response for %s was truncated", ErrTruncated, fqdn),
+		reason: reasonTruncated,
+	}
+}
+
+func (r *miekgResolver) IsNotFound(err error) bool {
+	return IsNotFound(err)
+}
+
+// godnsResolver resolves records using the Go standard library's
+// net.Resolver, deferring to the operating system's DNS configuration
+// (/etc/resolv.conf, search domains, /etc/hosts, musl/glibc quirks, ...).
+type godnsResolver struct {
+	resolver *net.Resolver
+}
+
+// NewGoDNSResolver returns a Resolver backed by net.Resolver, for
+// environments where the process should use the system's normal DNS
+// resolution instead of talking to an explicitly configured DNS server.
+func NewGoDNSResolver() Resolver {
+	return &godnsResolver{resolver: net.DefaultResolver}
+}
+
+func (r *godnsResolver) LookupSRV(name string) (srvs []SRV, err error) {
+	start := time.Now()
+	defer func() { observeLookup("SRV", start, err) }()
+
+	// Consul SRV names are fully qualified already (<service>.service.consul),
+	// not the usual _service._proto.name form, so ask net.Resolver to look
+	// the name up directly by passing empty service/proto.
+	_, addrs, err := r.resolver.LookupSRV(context.Background(), "", "", name)
+	if err != nil {
+		log.WithField("name", name).WithField("error", err).Error("Error during connection to system resolver")
+		err = wrapDNSError(err)
+		return nil, err
+	}
+
+	srvs = make([]SRV, 0, len(addrs))
+	for _, a := range addrs {
+		srvs = append(srvs, SRV{
+			Target:   a.Target,
+			Port:     a.Port,
+			Priority: a.Priority,
+			Weight:   a.Weight,
+			TTL:      godnsDefaultTTL,
+		})
+	}
+
+	return srvs, nil
+}
+
+func (r *godnsResolver) LookupA(target string) (ip net.IP, ttl time.Duration, err error) {
+	start := time.Now()
+	defer func() { observeLookup("A", start, err) }()
+
+	ips, err := r.resolver.LookupIP(context.Background(), "ip4", target)
+	if err != nil {
+		log.WithField("target", target).WithField("error", err).Error("Error during connection to system resolver")
+		err = wrapDNSError(err)
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		err = emptyAnswerError(target, "A")
+		return nil, 0, err
+	}
+	return ips[0], godnsDefaultTTL, nil
+}
+
+func (r *godnsResolver) LookupAAAA(target string) (ip net.IP, ttl time.Duration, err error) {
+	start := time.Now()
+	defer func() { observeLookup("AAAA", start, err) }()
+
+	ips, err := r.resolver.LookupIP(context.Background(), "ip6", target)
+	if err != nil {
+		log.WithField("target", target).WithField("error", err).Error("Error during connection to system resolver")
+		err = wrapDNSError(err)
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		err = emptyAnswerError(target, "AAAA")
+		return nil, 0, err
+	}
+	return ips[0], godnsDefaultTTL, nil
+}
+
+// wrapDNSError classifies an error from net.Resolver, wrapping it with
+// ErrNotFound when the resolver itself identified it as such.
+func wrapDNSError(err error) error {
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		return err
+	}
+	return &dnsError{
+		err:    fmt.Errorf("%w: %s", ErrNotFound, err),
+		reason: reasonNXDomain,
+	}
+}
+
+func (r *godnsResolver) IsNotFound(err error) bool {
+	return IsNotFound(err)
+}
@@ -0,0 +1,177 @@
+package servicediscovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDNSServers spins up a UDP and a TCP miekg/dns server on the same
+// port, backed by udpHandler and tcpHandler respectively, so a miekgResolver
+// can be pointed at it like a real DNS server.
+func startTestDNSServers(t *testing.T, udpHandler, tcpHandler dns.HandlerFunc) (addr string) {
+	t.Helper()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: udpHandler}
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: tcpHandler}
+
+	udpReady := make(chan struct{})
+	tcpReady := make(chan struct{})
+	udpServer.NotifyStartedFunc = func() { close(udpReady) }
+	tcpServer.NotifyStartedFunc = func() { close(tcpReady) }
+
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	<-udpReady
+	<-tcpReady
+
+	t.Cleanup(func() {
+		udpServer.Shutdown()
+		tcpServer.Shutdown()
+	})
+
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func truncatedHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	w.WriteMsg(m)
+}
+
+func srvAnswerHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.SRV{
+		Hdr:      dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 30},
+		Target:   "web1.service.consul.",
+		Port:     8080,
+		Priority: 1,
+		Weight:   1,
+	})
+	w.WriteMsg(m)
+}
+
+func TestMiekgResolverRetriesOverTCPWhenUDPTruncated(t *testing.T) {
+	addr := startTestDNSServers(t, truncatedHandler, srvAnswerHandler)
+
+	resolver, err := NewMiekgResolver(addr)
+	if err != nil {
+		t.Fatalf("NewMiekgResolver: %v", err)
+	}
+
+	srvs, err := resolver.LookupSRV("web.service.consul")
+	if err != nil {
+		t.Fatalf("LookupSRV: %v", err)
+	}
+
+	if len(srvs) != 1 || srvs[0].Target != "web1.service.consul." {
+		t.Fatalf("expected the TCP-retried answer, got %+v", srvs)
+	}
+}
+
+func TestMiekgResolverGivesUpWhenBothTruncated(t *testing.T) {
+	addr := startTestDNSServers(t, truncatedHandler, truncatedHandler)
+
+	resolver, err := NewMiekgResolver(addr)
+	if err != nil {
+		t.Fatalf("NewMiekgResolver: %v", err)
+	}
+
+	_, err = resolver.LookupSRV("web.service.consul")
+	if err == nil {
+		t.Fatalf("expected an error when both UDP and TCP responses are truncated")
+	}
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func aRecord(name string, ip net.IP) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA}, A: ip}
+}
+
+func aaaaRecord(name string, ip net.IP) *dns.AAAA {
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA}, AAAA: ip}
+}
+
+func cnameRecord(name, target string) *dns.CNAME {
+	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME}, Target: target}
+}
+
+func TestGlueFromExtra(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra []dns.RR
+		want  map[string][]net.IP
+	}{
+		{
+			name: "plain A and AAAA glue",
+			extra: []dns.RR{
+				aRecord("web1.service.consul.", net.ParseIP("10.0.0.1")),
+				aaaaRecord("web1.service.consul.", net.ParseIP("2001:db8::1")),
+			},
+			want: map[string][]net.IP{
+				"web1.service.consul.": {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")},
+			},
+		},
+		{
+			name: "single-hop CNAME to A",
+			extra: []dns.RR{
+				cnameRecord("web1.service.consul.", "web1.node.dc1.consul."),
+				aRecord("web1.node.dc1.consul.", net.ParseIP("10.0.0.2")),
+			},
+			want: map[string][]net.IP{
+				"web1.node.dc1.consul.": {net.ParseIP("10.0.0.2")},
+				"web1.service.consul.":  {net.ParseIP("10.0.0.2")},
+			},
+		},
+		{
+			name: "multi-hop CNAME chain",
+			extra: []dns.RR{
+				cnameRecord("web1.service.consul.", "alias1.consul."),
+				cnameRecord("alias1.consul.", "alias2.consul."),
+				aRecord("alias2.consul.", net.ParseIP("10.0.0.3")),
+			},
+			want: map[string][]net.IP{
+				"alias2.consul.":       {net.ParseIP("10.0.0.3")},
+				"alias1.consul.":       {net.ParseIP("10.0.0.3")},
+				"web1.service.consul.": {net.ParseIP("10.0.0.3")},
+			},
+		},
+		{
+			name: "chain that doesn't bottom out",
+			extra: []dns.RR{
+				cnameRecord("web1.service.consul.", "alias1.consul."),
+				cnameRecord("alias1.consul.", "alias2.consul."),
+				// alias2.consul. is never defined in Extra.
+			},
+			want: map[string][]net.IP{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := glueFromExtra(tt.extra)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("glueFromExtra() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package servicediscovery
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// SelectionStrategy controls how DiscoverService picks a single instance
+// from the set returned by DiscoverAllServiceInstances.
+type SelectionStrategy int
+
+const (
+	// RFC2782 performs the weighted, priority-grouped selection described
+	// in RFC 2782 section 4: lowest-priority group first, weighted random
+	// pick within the group.
+	RFC2782 SelectionStrategy = iota
+	RoundRobin
+	Random
+	FirstHealthy
+)
+
+// orderByPriorityAndWeight groups instances by ascending SRV priority and,
+// within each group, orders them by a repeated RFC 2782 weighted random
+// draw. This is both the ordering DiscoverAllServiceInstances returns and
+// the pool DiscoverServiceWeighted (and the RFC2782 SelectionStrategy) draw
+// their single pick from.
+func orderByPriorityAndWeight(instances []ServiceInstance) []ServiceInstance {
+	if len(instances) < 2 {
+		return instances
+	}
+
+	byPriority := make(map[uint16][]ServiceInstance)
+	priorities := make([]uint16, 0)
+	for _, inst := range instances {
+		if _, ok := byPriority[inst.Priority]; !ok {
+			priorities = append(priorities, inst.Priority)
+		}
+		byPriority[inst.Priority] = append(byPriority[inst.Priority], inst)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+
+	ordered := make([]ServiceInstance, 0, len(instances))
+	for _, priority := range priorities {
+		ordered = append(ordered, weightedOrder(byPriority[priority])...)
+	}
+	return ordered
+}
+
+// weightedOrder repeatedly performs an RFC 2782 weighted random draw over
+// the remaining instances in group, producing a full ordering rather than
+// just a single pick.
+func weightedOrder(group []ServiceInstance) []ServiceInstance {
+	remaining := append([]ServiceInstance(nil), group...)
+	ordered := make([]ServiceInstance, 0, len(remaining))
+
+	for len(remaining) > 0 {
+		idx := weightedPick(remaining)
+		ordered = append(ordered, remaining[idx])
+		remaining = append(remaining[:idx], remaining[idx+1:]...)
+	}
+
+	return ordered
+}
+
+// stableOrder sorts instances by IP then port, giving RoundRobin selection a
+// fixed cycle to advance through call after call. It's distinct from the
+// ordering orderByPriorityAndWeight returns, which re-draws a fresh weighted
+// random permutation on every call and so can't be used as a RoundRobin
+// cursor without effectively making it indistinguishable from Random.
+func stableOrder(instances []ServiceInstance) []ServiceInstance {
+	ordered := append([]ServiceInstance(nil), instances...)
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Ip != ordered[j].Ip {
+			return ordered[i].Ip < ordered[j].Ip
+		}
+		return ordered[i].Port < ordered[j].Port
+	})
+	return ordered
+}
+
+// weightedPick implements the RFC 2782 weighted random selection: pick a
+// random number in [0, sum(weights)] and walk the group summing weights
+// until the running total meets or exceeds it. Entries with weight 0 are
+// eligible only when every entry in the group has weight 0, in which case
+// this degrades to a uniform pick.
+func weightedPick(group []ServiceInstance) int {
+	var total uint32
+	for _, inst := range group {
+		total += uint32(inst.Weight)
+	}
+
+	if total == 0 {
+		return rand.Intn(len(group))
+	}
+
+	r := uint32(rand.Int63n(int64(total) + 1))
+	var running uint32
+	for i, inst := range group {
+		if inst.Weight == 0 {
+			continue
+		}
+		running += uint32(inst.Weight)
+		if running >= r {
+			return i
+		}
+	}
+	return len(group) - 1
+}
@@ -0,0 +1,118 @@
+package servicediscovery
+
+import (
+	"testing"
+)
+
+func TestWeightedPickHonorsWeight(t *testing.T) {
+	group := []ServiceInstance{
+		{Ip: "10.0.0.1", Weight: 1},
+		{Ip: "10.0.0.2", Weight: 99},
+	}
+
+	counts := make([]int, len(group))
+	const trials = 10000
+	for i := 0; i < trials; i++ {
+		counts[weightedPick(group)]++
+	}
+
+	// The heavily-weighted entry should win the overwhelming majority of
+	// draws; a wide tolerance keeps this from flaking on the random draw.
+	if counts[1] < trials/2 {
+		t.Fatalf("expected the weight-99 entry to dominate, got counts %v", counts)
+	}
+}
+
+func TestWeightedPickAllZeroIsUniform(t *testing.T) {
+	group := []ServiceInstance{
+		{Ip: "10.0.0.1"},
+		{Ip: "10.0.0.2"},
+		{Ip: "10.0.0.3"},
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		idx := weightedPick(group)
+		if idx < 0 || idx >= len(group) {
+			t.Fatalf("weightedPick returned out-of-range index %d", idx)
+		}
+		seen[idx] = true
+	}
+
+	if len(seen) != len(group) {
+		t.Fatalf("expected weightedPick to eventually hit every index with all-zero weights, saw %v", seen)
+	}
+}
+
+func TestWeightedOrderIsPermutation(t *testing.T) {
+	group := []ServiceInstance{
+		{Ip: "10.0.0.1", Weight: 5},
+		{Ip: "10.0.0.2", Weight: 0},
+		{Ip: "10.0.0.3", Weight: 10},
+	}
+
+	ordered := weightedOrder(group)
+	if len(ordered) != len(group) {
+		t.Fatalf("expected %d instances, got %d", len(group), len(ordered))
+	}
+
+	seen := make(map[string]bool)
+	for _, inst := range ordered {
+		seen[inst.Ip] = true
+	}
+	for _, inst := range group {
+		if !seen[inst.Ip] {
+			t.Fatalf("weightedOrder dropped %s", inst.Ip)
+		}
+	}
+}
+
+func TestOrderByPriorityAndWeightGroupsByPriority(t *testing.T) {
+	instances := []ServiceInstance{
+		{Ip: "10.0.0.1", Priority: 10, Weight: 1},
+		{Ip: "10.0.0.2", Priority: 0, Weight: 1},
+		{Ip: "10.0.0.3", Priority: 10, Weight: 1},
+		{Ip: "10.0.0.4", Priority: 0, Weight: 1},
+	}
+
+	ordered := orderByPriorityAndWeight(instances)
+	if len(ordered) != len(instances) {
+		t.Fatalf("expected %d instances, got %d", len(instances), len(ordered))
+	}
+
+	// Both priority-0 instances must come before both priority-10 instances.
+	for i, inst := range ordered {
+		wantPriority := uint16(0)
+		if i >= 2 {
+			wantPriority = 10
+		}
+		if inst.Priority != wantPriority {
+			t.Fatalf("index %d: expected priority %d, got %d (full order %v)", i, wantPriority, inst.Priority, ordered)
+		}
+	}
+}
+
+func TestStableOrderIsDeterministic(t *testing.T) {
+	instances := []ServiceInstance{
+		{Ip: "10.0.0.3", Port: "80"},
+		{Ip: "10.0.0.1", Port: "80"},
+		{Ip: "10.0.0.2", Port: "80"},
+	}
+
+	first := stableOrder(instances)
+	for i := 0; i < 10; i++ {
+		again := stableOrder(instances)
+		for j := range first {
+			if first[j].Ip != again[j].Ip {
+				t.Fatalf("stableOrder is not deterministic: %v vs %v", first, again)
+			}
+		}
+	}
+
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	for i, inst := range first {
+		if inst.Ip != want[i] {
+			t.Fatalf("expected sorted order %v, got %v", want, first)
+		}
+	}
+}